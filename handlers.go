@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -26,10 +28,16 @@ implementing the GitHub App Manifest Flow, so that you don't have to.
 This endpoint initiates an app creation flow. You must provide it with the
 following keys, encoded as JSON:
 
-manifest    - A JSON object, acceptable by GitHub's manifest flow [1].
-target_type - The account type that this GitHub App should be created on (user, org).
-target_slug - The account slug to create this GitHub App on.
-host        - The GitHub instance to use (usually github.com).
+manifest                 - A JSON object, acceptable by GitHub's manifest flow [1].
+target_type              - The account type that this GitHub App should be created on (user, org).
+target_slug              - The account slug to create this GitHub App on.
+host                     - The GitHub instance to use (usually github.com).
+callback_webhook         - (optional) An https:// URL to receive a CloudEvents notification
+                           once the flow completes, instead of having to poll POST /code/:key.
+                           Must resolve to a public address; loopback, link-local and private
+                           targets are rejected.
+callback_webhook_secret  - (optional) A secret used to HMAC-SHA256 sign deliveries to
+                           callback_webhook, carried in the X-Gamf-Signature header.
 
 A JSON object containing the following keys will be returned
 
@@ -50,6 +58,23 @@ A JSON object containing the following keys will be returned:
 
 code - The GitHub App Manifest code, to be used to retrieve you new app configuration.
 
+Add a wait query parameter (e.g. ?wait=30s, capped at 60s) to long-poll
+instead of getting an immediate 404 while the flow is still in progress, or
+send an Accept: text/event-stream header to instead receive the code as a
+single "code" (or "timeout") server-sent event.
+
+
+### /v2
+
+A /v2/start and /v2/code/:key pair shares the same underlying flow and code
+lookup as the endpoints above (startFlow, waitForCode), but returns errors as
+{"error": {"code", "message", "request_id"}}, validates the manifest up front
+with per-field messages, maps a code that expired before it was fetched to 410
+instead of 404 (memory and Postgres stores; Redis drops expired keys, so there
+it stays 404, as does an already-consumed code), and supports bearer-token auth on /v2/start via the GAMF_API_TOKENS
+environment variable. /code/:key additionally supports Server-Sent Events,
+which /v2/code/:key does not. /start and /code/:key remain available
+unchanged for existing consumers during migration.
 
 [1] https://docs.github.com/en/developers/apps/building-github-apps/creating-a-github-app-from-a-manifest#github-app-manifest-parameters
 [2] https://docs.github.com/en/developers/apps/building-github-apps/creating-a-github-app-from-a-manifest#1-you-redirect-people-to-github-to-create-a-new-github-app
@@ -90,89 +115,126 @@ type manifest struct {
 }
 
 type startRequest struct {
-	Manifest   manifest `json:"manifest"`
-	TargetType string   `json:"target_type"`
-	TargetSlug string   `json:"target_slug"`
-	Host       string   `json:"host"`
-	Token      string   `json:"token"`
+	Manifest        manifest `json:"manifest"`
+	TargetType      string   `json:"target_type"`
+	TargetSlug      string   `json:"target_slug"`
+	Host            string   `json:"host"`
+	Token           string   `json:"token"`
+	CallbackWebhook string   `json:"callback_webhook"`
+	CallbackSecret  string   `json:"callback_webhook_secret"`
+}
+
+// webhookMeta is the subset of a startRequest needed to deliver the
+// dev.gamf.app.created CloudEvent once CallbackHandler observes the code. It
+// is stored under its own key, keyed by state token, since by the time the
+// callback lands the "i:" entry RedirectHandler consumed is already gone.
+type webhookMeta struct {
+	URL        string `json:"url"`
+	Secret     string `json:"secret"`
+	TargetType string `json:"target_type"`
+	TargetSlug string `json:"target_slug"`
+	Host       string `json:"host"`
+}
+
+// startFlow generates the tokens for a new manifest flow, points the
+// manifest's redirect_url at this instance's /callback, and persists the
+// request under its initial (browser-facing) token. It is shared by
+// StartHandler and V2StartHandler so the two only differ in how they decode
+// the request and report errors.
+func startFlow(ctx context.Context, baseURL string, store Store, request startRequest) (key, redirectURL string, err error) {
+	if request.CallbackWebhook != "" {
+		if _, err := validateWebhookURL(request.CallbackWebhook); err != nil {
+			return "", "", err
+		}
+	}
+
+	initialToken, err := token()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate a random token: %w", err)
+	}
+
+	stateToken, err := token()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate a random token: %w", err)
+	}
+
+	request.Token = stateToken
+	request.Manifest.RedirectURL = fmt.Sprintf("%v/callback", baseURL)
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal payload for storage: %w", err)
+	}
+
+	if err := store.SetEx(ctx, "i:"+initialToken, string(payload), 10*time.Minute); err != nil {
+		return "", "", err
+	}
+
+	return stateToken, fmt.Sprintf("%v/redirect/%v", baseURL, initialToken), nil
+}
+
+// writeV1Error writes the flat {"error": "<message>"} shape the v1 surface
+// has always used (as opposed to /v2's structured envelope), via
+// json.Marshal rather than hand-built strings so a stray quote or brace
+// can't produce invalid JSON.
+func writeV1Error(w http.ResponseWriter, status int, message string) {
+	payload, err := json.Marshal(struct {
+		Error string `json:"error"`
+	}{Error: message})
+	if err != nil {
+		fmt.Printf("error: failed to marshal v1 error body: %v\n", err)
+		payload = []byte(`{"error":"internal error"}`)
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(payload)
 }
 
 func StartHandler(baseURL string, store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var request startRequest
 		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Header().Add("Content-Type", "application/json")
 			fmt.Printf("error: %v\n", err)
-			w.Write([]byte(`{"error": "failed to parse request"}`))
+			writeV1Error(w, http.StatusBadRequest, "failed to parse request")
 
 			return
 		}
 
-		initialToken, err := token()
+		key, redirectURL, err := startFlow(r.Context(), baseURL, store, request)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Header().Add("Content-Type", "application/json")
-			w.Write([]byte(`{"error": "failed to generate a random token"}`))
-
-			return
-		}
-
-		stateToken, err := token()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Header().Add("Content-Type", "application/json")
-			w.Write([]byte(`{"error": "failed to generate a random token"}`))
+			if errors.Is(err, ErrStoreUnavailable) {
+				respondStoreUnavailable(w)
 
-			return
-		}
-
-		request.Token = stateToken
-		request.Manifest.RedirectURL = fmt.Sprintf("%v/callback", baseURL)
+				return
+			}
 
-		payload, err := json.Marshal(request)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Header().Add("Content-Type", "application/json")
-			w.Write([]byte(`{"error": "failed to marshal payload for storage"}`))
+			if errors.Is(err, ErrInvalidCallbackWebhook) {
+				writeV1Error(w, http.StatusBadRequest, "invalid callback_webhook")
 
-			return
-		}
+				return
+			}
 
-		if err := store.SetEx(
-			r.Context(),
-			"i:"+initialToken,
-			string(payload),
-			10*time.Minute,
-		); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Header().Add("Content-Type", "application/json")
-			w.Write([]byte(`{"error": "failed to store payload"}`))
+			writeV1Error(w, http.StatusInternalServerError, "failed to start flow")
 
 			return
 		}
 
-		w.Header().Add("Content-Type", "application/json")
-
-		response := struct {
+		response, err := json.Marshal(struct {
 			Key string `json:"key"`
 			URL string `json:"url"`
 		}{
-			Key: stateToken,
-			URL: fmt.Sprintf("%v/redirect/%v", baseURL, initialToken),
-		}
-
-		jsonResponse, err := json.Marshal(response)
+			Key: key,
+			URL: redirectURL,
+		})
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Header().Add("Content-Type", "application/json")
-			w.Write([]byte(`{"error": "failed to generate response"}`))
+			writeV1Error(w, http.StatusInternalServerError, "failed to generate response")
 
 			return
-
 		}
 
-		w.Write(jsonResponse)
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(response)
 	}
 }
 
@@ -232,6 +294,10 @@ func RedirectHandler(store Store) http.HandlerFunc {
 			return
 		}
 
+		if m.CallbackWebhook != "" {
+			storeWebhookMeta(r, store, m)
+		}
+
 		data := &redirectTemplate{
 			Action:   actionURL(m),
 			Manifest: string(manifestJSON),
@@ -241,6 +307,30 @@ func RedirectHandler(store Store) http.HandlerFunc {
 	}
 }
 
+// storeWebhookMeta persists the callback webhook URL and secret for state so
+// CallbackHandler can deliver the completion event once it has a code. It is
+// best-effort: a failure here just means the flow falls back to polling.
+func storeWebhookMeta(r *http.Request, store Store, m startRequest) {
+	meta := webhookMeta{
+		URL:        m.CallbackWebhook,
+		Secret:     m.CallbackSecret,
+		TargetType: m.TargetType,
+		TargetSlug: m.TargetSlug,
+		Host:       m.Host,
+	}
+
+	payload, err := json.Marshal(meta)
+	if err != nil {
+		fmt.Printf("error: failed to marshal webhook metadata: %v\n", err)
+
+		return
+	}
+
+	if err := store.SetEx(r.Context(), "w:"+m.Token, string(payload), 5*time.Minute); err != nil {
+		fmt.Printf("error: failed to store webhook metadata: %v\n", err)
+	}
+}
+
 func actionURL(data startRequest) string {
 	if data.TargetType == "org" {
 		return fmt.Sprintf("https://%v/organizations/%v/settings/apps/new?state=%v", data.Host, data.TargetSlug, data.Token)
@@ -249,7 +339,7 @@ func actionURL(data startRequest) string {
 	}
 }
 
-func CallbackHandler(store Store) http.HandlerFunc {
+func CallbackHandler(baseURL string, store Store, dispatcher *WebhookDispatcher) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		state, code := r.FormValue("state"), r.FormValue("code")
 
@@ -262,6 +352,12 @@ func CallbackHandler(store Store) http.HandlerFunc {
 		}
 
 		if err := store.SetEx(r.Context(), "s:"+state, code, 5*time.Minute); err != nil {
+			if errors.Is(err, ErrStoreUnavailable) {
+				respondStoreUnavailable(w)
+
+				return
+			}
+
 			w.WriteHeader(http.StatusBadRequest)
 			w.Header().Add("Content-Type", "text/plain")
 			w.Write([]byte("Error: failed to store code."))
@@ -269,34 +365,206 @@ func CallbackHandler(store Store) http.HandlerFunc {
 			return
 		}
 
+		deliverAppCreatedEvent(r, baseURL, store, dispatcher, state)
+
 		http.Redirect(w, r, "/done", http.StatusFound)
 	}
 }
 
+// deliverAppCreatedEvent looks up any webhook registered for state via
+// StartHandler's callback_webhook field and, if present, enqueues the
+// dev.gamf.app.created CloudEvent for delivery. redis.Nil means no metadata
+// is stored for state: either the caller didn't ask for push delivery or, on
+// Redis, the entry's TTL ran out before the user got back from GitHub's
+// manifest UI (Redis deletes expired keys, so the two look the same); it is
+// not logged. Any other error (ErrGone for an expired entry on the memory and
+// Postgres stores, or the store being unavailable) is a real, silent delivery
+// failure and gets logged so it's at least observable.
+func deliverAppCreatedEvent(r *http.Request, baseURL string, store Store, dispatcher *WebhookDispatcher, state string) {
+	raw, err := store.GetDel(r.Context(), "w:"+state)
+	if err != nil {
+		if err != redis.Nil {
+			fmt.Printf("error: failed to fetch webhook metadata for state %v: %v\n", state, err)
+		}
+
+		return
+	}
+
+	var meta webhookMeta
+	if err := json.Unmarshal([]byte(raw), &meta); err != nil {
+		fmt.Printf("error: failed to parse webhook metadata: %v\n", err)
+
+		return
+	}
+
+	event, err := newAppCreatedEvent(baseURL, state, appCreatedData{
+		Key:        state,
+		TargetType: meta.TargetType,
+		TargetSlug: meta.TargetSlug,
+		Host:       meta.Host,
+	})
+	if err != nil {
+		fmt.Printf("error: failed to build webhook event: %v\n", err)
+
+		return
+	}
+
+	dispatcher.Deliver(meta.URL, meta.Secret, event)
+}
+
+// maxCodeWait is the ceiling on the wait query parameter accepted by
+// CodeHandler, so a single slow poller can't tie up a connection
+// indefinitely.
+const maxCodeWait = 60 * time.Second
+
+// fetchCode resolves the code for key, either immediately (wait<=0) or by
+// blocking up to wait via waitForCode. Both the v1 and v2 /code handlers
+// call this so they fetch identically and only differ in how the result is
+// rendered over the wire (v1's SSE mode is the one exception, handled
+// separately by serveCodeSSE since /v2 has no SSE equivalent).
+func fetchCode(ctx context.Context, store Store, key string, wait time.Duration) (string, error) {
+	if wait <= 0 {
+		return store.GetDel(ctx, key)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	return waitForCode(waitCtx, store, key)
+}
+
 func CodeHandler(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		key := mux.Vars(r)["key"]
+		key := "s:" + mux.Vars(r)["key"]
+		wait := parseCodeWait(r.URL.Query().Get("wait"))
 
-		code, err := store.GetDel(r.Context(), "s:"+key)
-		if err != nil {
-			if err == redis.Nil {
-				w.WriteHeader(http.StatusNotFound)
-				w.Header().Add("Content-Type", "application/json")
-				w.Write([]byte(`{"error": "failed to find code for the given key"}`))
-			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-				w.Header().Add("Content-Type", "application/json")
-				w.Write([]byte(`"error": "failed to fetch code"}`))
-			}
+		if sseRequested(r) {
+			serveCodeSSE(w, r, store, key, wait)
 
 			return
 		}
 
-		response := fmt.Sprintf(`{"code": "%v"}`, code)
+		code, err := fetchCode(r.Context(), store, key, wait)
+		writeCodeResponse(w, code, err)
+	}
+}
+
+func sseRequested(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// parseCodeWait parses the wait query parameter into a duration, clamped to
+// maxCodeWait. A missing or invalid value disables long-polling, preserving
+// today's immediate-response behaviour.
+func parseCodeWait(raw string) time.Duration {
+	if raw == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0
+	}
+
+	if d > maxCodeWait {
+		return maxCodeWait
+	}
+
+	return d
+}
+
+// waitForCode blocks until key is set or ctx is done. It subscribes via
+// Notify before the fallback GetDel so a code set between the two can't slip
+// through unnoticed. If Notify itself fails, it does not block and returns
+// the result of a single immediate GetDel instead.
+func waitForCode(ctx context.Context, store Store, key string) (string, error) {
+	notifyCh, err := store.Notify(ctx, key)
+	if err != nil {
+		return store.GetDel(ctx, key)
+	}
+
+	if code, err := store.GetDel(ctx, key); err == nil || err != redis.Nil {
+		return code, err
+	}
+
+	select {
+	case <-notifyCh:
+		return store.GetDel(ctx, key)
+	case <-ctx.Done():
+		return "", redis.Nil
+	}
+}
 
+func serveCodeSSE(w http.ResponseWriter, r *http.Request, store Store, key string, wait time.Duration) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
 		w.Header().Add("Content-Type", "application/json")
-		w.Write([]byte(response))
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "streaming unsupported"}`))
+
+		return
 	}
+
+	if wait <= 0 {
+		wait = maxCodeWait
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	code, err := waitForCode(ctx, store, key)
+	if err != nil {
+		fmt.Fprint(w, "event: timeout\ndata: {}\n\n")
+		flusher.Flush()
+
+		return
+	}
+
+	fmt.Fprintf(w, "event: code\ndata: {\"code\": \"%v\"}\n\n", code)
+	flusher.Flush()
+}
+
+func writeCodeResponse(w http.ResponseWriter, code string, err error) {
+	if err != nil {
+		switch {
+		case err == redis.Nil, errors.Is(err, ErrGone):
+			writeV1Error(w, http.StatusNotFound, "failed to find code for the given key")
+		case errors.Is(err, ErrStoreUnavailable):
+			respondStoreUnavailable(w)
+		default:
+			writeV1Error(w, http.StatusInternalServerError, "failed to fetch code")
+		}
+
+		return
+	}
+
+	response, err := json.Marshal(struct {
+		Code string `json:"code"`
+	}{Code: code})
+	if err != nil {
+		writeV1Error(w, http.StatusInternalServerError, "failed to generate response")
+
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// respondStoreUnavailable writes a 503 with a Retry-After hint for a caller
+// that hit an open circuit breaker, so it backs off instead of retrying an
+// already-struggling store immediately.
+func respondStoreUnavailable(w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Retry-After", "5")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(`{"error": "store temporarily unavailable"}`))
 }
 
 func token() (string, error) {
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestWriteCodeResponseSuccessIsValidJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	writeCodeResponse(w, "abc123", nil)
+
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response body is not valid JSON: %v (body: %q)", err, w.Body.String())
+	}
+
+	if body.Code != "abc123" {
+		t.Fatalf("code = %q, want %q", body.Code, "abc123")
+	}
+}
+
+func TestWriteCodeResponseErrorIsValidJSON(t *testing.T) {
+	cases := []error{redis.Nil, ErrGone, errors.New("unexpected store error")}
+
+	for _, err := range cases {
+		w := httptest.NewRecorder()
+
+		writeCodeResponse(w, "", err)
+
+		var body struct {
+			Error string `json:"error"`
+		}
+		if jsonErr := json.Unmarshal(w.Body.Bytes(), &body); jsonErr != nil {
+			t.Fatalf("response body for %v is not valid JSON: %v (body: %q)", err, jsonErr, w.Body.String())
+		}
+
+		if body.Error == "" {
+			t.Fatalf("expected a non-empty error message for %v", err)
+		}
+	}
+}
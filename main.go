@@ -9,6 +9,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -52,10 +53,16 @@ func realMain() error {
 		return fmt.Errorf("error fetching environment: %w", err)
 	}
 
-	redisClient, err := setupRedis(env["REDIS_URL"])
+	storeURL := env["REDIS_URL"]
+	if v, ok := os.LookupEnv("GAMF_STORE_URL"); ok {
+		storeURL = v
+	}
+
+	store, err := NewStore(context.Background(), storeURL)
 	if err != nil {
-		return fmt.Errorf("error configuring redis: %w", err)
+		return fmt.Errorf("error configuring store: %w", err)
 	}
+	defer store.Close()
 
 	closer, err := initObs(context.Background(), "gamf-http", env)
 	if err != nil {
@@ -63,16 +70,21 @@ func realMain() error {
 	}
 	defer closer()
 
-	store := NewRedisStore(redisClient)
+	dispatcher := NewWebhookDispatcher(webhookWorkers)
+	apiTokens := v2TokensFromEnv()
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", HomeHandler).Methods(http.MethodGet)
 	r.HandleFunc("/start", StartHandler(env["GAMF_URL"], store)).Methods(http.MethodPost)
 	r.HandleFunc("/redirect/{initialKey}", RedirectHandler(store)).Methods(http.MethodGet)
-	r.HandleFunc("/callback", CallbackHandler(store)).Methods(http.MethodGet)
+	r.HandleFunc("/callback", CallbackHandler(env["GAMF_URL"], store, dispatcher)).Methods(http.MethodGet)
 	r.HandleFunc("/code/{key}", CodeHandler(store)).Methods(http.MethodPost)
 	r.HandleFunc("/done", DoneHandler).Methods(http.MethodGet)
 
+	v2 := r.PathPrefix("/v2").Subrouter()
+	v2.HandleFunc("/start", V2StartHandler(env["GAMF_URL"], store, apiTokens)).Methods(http.MethodPost)
+	v2.HandleFunc("/code/{key}", V2CodeHandler(store)).Methods(http.MethodPost)
+
 	return RunServer(env["PORT"], r)
 }
 
@@ -80,10 +92,39 @@ func loggingHandler(n http.Handler) http.Handler {
 	return handlers.LoggingHandler(os.Stdout, n)
 }
 
-func timeoutHandler(t time.Duration) func(http.Handler) http.Handler {
-	return func(n http.Handler) http.Handler {
-		return http.TimeoutHandler(n, t, http.StatusText(http.StatusServiceUnavailable))
-	}
+// defaultRequestTimeout bounds ordinary, non-blocking requests. codeRequestTimeout
+// covers /code/{key}'s wait long-poll/SSE path, which deliberately blocks up to
+// maxCodeWait; it needs its own, longer timeout or the server would cut the
+// request off long before the handler's own wait logic ever matters.
+const (
+	defaultRequestTimeout = 5 * time.Second
+	codeRequestTimeout    = maxCodeWait + 5*time.Second
+)
+
+// adaptiveTimeoutHandler applies codeRequestTimeout to the long-poll/SSE
+// /code/{key} routes (v1 and v2) and defaultRequestTimeout to everything
+// else, since those are the only routes expected to block. The code routes
+// get it as a context deadline rather than through http.TimeoutHandler,
+// whose ResponseWriter is not an http.Flusher and would break SSE.
+func adaptiveTimeoutHandler(n http.Handler) http.Handler {
+	defaultHandler := http.TimeoutHandler(n, defaultRequestTimeout, http.StatusText(http.StatusServiceUnavailable))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isCodeRoute(r.URL.Path) {
+			ctx, cancel := context.WithTimeout(r.Context(), codeRequestTimeout)
+			defer cancel()
+
+			n.ServeHTTP(w, r.WithContext(ctx))
+
+			return
+		}
+
+		defaultHandler.ServeHTTP(w, r)
+	})
+}
+
+func isCodeRoute(path string) bool {
+	return strings.HasPrefix(path, "/code/") || strings.HasPrefix(path, "/v2/code/")
 }
 
 func obs(n http.Handler) http.Handler {
@@ -100,7 +141,8 @@ func RunServer(port string, r *mux.Router) error {
 		loggingHandler,
 		otelmux.Middleware("gamf-http"),
 		obs,
-		timeoutHandler(5*time.Second),
+		requestIDMiddleware,
+		adaptiveTimeoutHandler,
 	)
 
 	r.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -108,8 +150,12 @@ func RunServer(port string, r *mux.Router) error {
 	})
 
 	server := &http.Server{
-		Addr:         "0.0.0.0:" + port,
-		WriteTimeout: time.Second * 5,
+		Addr: "0.0.0.0:" + port,
+		// WriteTimeout is a hard per-connection ceiling that mux middleware
+		// can't scope per-route, so it has to cover the longest-blocking
+		// handler (the /code wait long-poll/SSE path) rather than the 5s
+		// default most routes actually need.
+		WriteTimeout: codeRequestTimeout,
 		ReadTimeout:  time.Second * 5,
 		IdleTimeout:  time.Second * 60,
 		Handler:      r,
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrStoreUnavailable is returned by Store implementations when an open
+// circuit breaker fast-fails a request rather than letting it hit an
+// already-struggling backend.
+var ErrStoreUnavailable = errors.New("store: unavailable")
+
+const (
+	redisRetryInitialInterval = 50 * time.Millisecond
+	redisRetryFactor          = 1.5
+	redisRetryMaxInterval     = 2 * time.Second
+	redisRetryMaxElapsed      = 5 * time.Second
+
+	defaultRedisBreakerThreshold = 5
+	redisBreakerWindow           = 30 * time.Second
+	redisBreakerCooldown         = 10 * time.Second
+)
+
+func redisBreakerThreshold() int {
+	v, ok := os.LookupEnv("GAMF_REDIS_BREAKER_THRESHOLD")
+	if !ok {
+		return defaultRedisBreakerThreshold
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return defaultRedisBreakerThreshold
+	}
+
+	return n
+}
+
+// redisRetry runs fn with exponential backoff and full jitter, retrying only
+// on errors that look transient (dial hiccups, a closed client) and never on
+// redis.Nil or cancellation the caller itself requested.
+func redisRetry(ctx context.Context, fn func() error) error {
+	start := time.Now()
+	interval := redisRetryInitialInterval
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		if !isTransientRedisErr(ctx, err) {
+			return err
+		}
+
+		if time.Since(start) >= redisRetryMaxElapsed {
+			return err
+		}
+
+		recordRetryEvent(ctx, attempt, err)
+
+		delay := time.Duration(rand.Int63n(int64(interval)))
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		interval = time.Duration(float64(interval) * redisRetryFactor)
+		if interval > redisRetryMaxInterval {
+			interval = redisRetryMaxInterval
+		}
+	}
+}
+
+func isTransientRedisErr(ctx context.Context, err error) bool {
+	if err == nil || err == redis.Nil {
+		return false
+	}
+
+	// The caller cancelled or timed out the context themselves; retrying
+	// would just spin until redisRetryMaxElapsed for no benefit.
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Temporary() {
+		return true
+	}
+
+	return errors.Is(err, io.EOF) || errors.Is(err, redis.ErrClosed) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func recordRetryEvent(ctx context.Context, attempt int, err error) {
+	trace.SpanFromContext(ctx).AddEvent("redis.retry", trace.WithAttributes(
+		attribute.Int("attempt", attempt),
+		attribute.String("error", err.Error()),
+	))
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker opens after a run of consecutive failures within a rolling
+// window, fast-failing callers with ErrStoreUnavailable until a cooldown
+// elapses, at which point a single trial request is let through to decide
+// whether to close again.
+type circuitBreaker struct {
+	mu sync.Mutex
+
+	threshold int
+	failures  int
+	since     time.Time
+	state     breakerState
+	openedAt  time.Time
+	trial     bool
+}
+
+func newCircuitBreaker(threshold int) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold}
+}
+
+// allow reports whether a request may proceed, admitting a single trial
+// request once the cooldown has elapsed for an open breaker.
+func (cb *circuitBreaker) allow(ctx context.Context) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		// A trial request is already in flight; every other concurrent
+		// caller is rejected until record() resolves it one way or the
+		// other, or admitting all of them would defeat the point of the
+		// trial.
+		return false
+	default: // breakerOpen
+		if time.Since(cb.openedAt) < redisBreakerCooldown {
+			return false
+		}
+
+		cb.trial = true
+		cb.transition(ctx, breakerHalfOpen)
+
+		return true
+	}
+}
+
+func (cb *circuitBreaker) record(ctx context.Context, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if err == nil || err == redis.Nil {
+		cb.failures = 0
+		cb.trial = false
+
+		if cb.state != breakerClosed {
+			cb.transition(ctx, breakerClosed)
+		}
+
+		return
+	}
+
+	if ctx.Err() != nil {
+		// The caller cancelled or timed out; that's not a store-health
+		// signal, so don't let it count towards tripping the breaker. An
+		// abandoned trial sends a half-open breaker back to open, with its
+		// cooldown already elapsed, so the next caller becomes the trial.
+		if cb.state == breakerHalfOpen {
+			cb.trial = false
+			cb.transition(ctx, breakerOpen)
+		}
+
+		return
+	}
+
+	now := time.Now()
+	if cb.since.IsZero() || now.Sub(cb.since) > redisBreakerWindow {
+		cb.since = now
+		cb.failures = 0
+	}
+
+	cb.failures++
+
+	if cb.state == breakerHalfOpen || cb.failures >= cb.threshold {
+		cb.openedAt = now
+		cb.trial = false
+		cb.transition(ctx, breakerOpen)
+	}
+}
+
+func (cb *circuitBreaker) transition(ctx context.Context, to breakerState) {
+	from := cb.state
+	cb.state = to
+
+	if from == to {
+		return
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("redis.circuit_breaker", trace.WithAttributes(
+		attribute.String("from", breakerStateLabel(from)),
+		attribute.String("to", breakerStateLabel(to)),
+	))
+}
+
+func breakerStateLabel(s breakerState) string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerHalfOpenAdmitsSingleTrial(t *testing.T) {
+	cb := newCircuitBreaker(1)
+	ctx := context.Background()
+
+	if !cb.allow(ctx) {
+		t.Fatal("closed breaker should allow")
+	}
+
+	cb.record(ctx, errors.New("boom"))
+
+	cb.mu.Lock()
+	cb.openedAt = time.Now().Add(-redisBreakerCooldown)
+	cb.mu.Unlock()
+
+	const callers = 20
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		admitted int
+	)
+
+	wg.Add(callers)
+
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+
+			if cb.allow(ctx) {
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if admitted != 1 {
+		t.Fatalf("half-open breaker admitted %d concurrent callers, want exactly 1", admitted)
+	}
+}
+
+func TestCircuitBreakerRecordClosesOnSuccess(t *testing.T) {
+	cb := newCircuitBreaker(1)
+	ctx := context.Background()
+
+	cb.record(ctx, errors.New("boom"))
+
+	cb.mu.Lock()
+	cb.openedAt = time.Now().Add(-redisBreakerCooldown)
+	cb.mu.Unlock()
+
+	if !cb.allow(ctx) {
+		t.Fatal("expected trial request to be admitted")
+	}
+
+	cb.record(ctx, nil)
+
+	cb.mu.Lock()
+	state := cb.state
+	cb.mu.Unlock()
+
+	if state != breakerClosed {
+		t.Fatalf("breaker state = %v, want breakerClosed", state)
+	}
+
+	if !cb.allow(ctx) {
+		t.Fatal("closed breaker should allow after a successful trial")
+	}
+}
+
+func TestCircuitBreakerRecordReopensOnTrialFailure(t *testing.T) {
+	cb := newCircuitBreaker(1)
+	ctx := context.Background()
+
+	cb.record(ctx, errors.New("boom"))
+
+	cb.mu.Lock()
+	cb.openedAt = time.Now().Add(-redisBreakerCooldown)
+	cb.mu.Unlock()
+
+	if !cb.allow(ctx) {
+		t.Fatal("expected trial request to be admitted")
+	}
+
+	cb.record(ctx, errors.New("still broken"))
+
+	cb.mu.Lock()
+	state := cb.state
+	cb.mu.Unlock()
+
+	if state != breakerOpen {
+		t.Fatalf("breaker state = %v, want breakerOpen", state)
+	}
+
+	if cb.allow(ctx) {
+		t.Fatal("breaker should reject immediately after reopening")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRedisRetrySucceedsAfterTransientErrors(t *testing.T) {
+	attempts := 0
+
+	err := redisRetry(context.Background(), func() error {
+		attempts++
+		if attempts < 3 {
+			return io.EOF
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("redisRetry returned error: %v", err)
+	}
+
+	if attempts != 3 {
+		t.Fatalf("redisRetry ran fn %v times, want 3", attempts)
+	}
+}
+
+func TestRedisRetryStopsOnNonTransientError(t *testing.T) {
+	permanent := errors.New("permanent failure")
+	attempts := 0
+
+	err := redisRetry(context.Background(), func() error {
+		attempts++
+
+		return permanent
+	})
+	if !errors.Is(err, permanent) {
+		t.Fatalf("redisRetry returned %v, want %v", err, permanent)
+	}
+
+	if attempts != 1 {
+		t.Fatalf("redisRetry ran fn %v times for a non-transient error, want 1", attempts)
+	}
+}
+
+func TestRedisRetryGivesUpAfterMaxElapsed(t *testing.T) {
+	attempts := 0
+
+	err := redisRetry(context.Background(), func() error {
+		attempts++
+
+		return io.EOF
+	})
+	if err != io.EOF {
+		t.Fatalf("redisRetry returned %v, want io.EOF", err)
+	}
+
+	if attempts < 2 {
+		t.Fatalf("redisRetry only ran fn %v time(s), expected multiple retries before giving up", attempts)
+	}
+}
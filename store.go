@@ -2,15 +2,62 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
 	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	_ "github.com/lib/pq"
 )
 
+// ErrGone is returned by GetDel when a key is found to have already expired,
+// as distinct from having never existed (redis.Nil). Redis itself can't draw
+// this distinction since it deletes TTL'd keys outright, so only the
+// memory and Postgres backends ever return it.
+var ErrGone = errors.New("store: key expired")
+
 type Store interface {
 	GetDel(context.Context, string) (string, error)
 	SetEx(context.Context, string, string, time.Duration) error
+
+	// Notify returns a channel that receives a value once key is set, so a
+	// caller can block on it instead of polling GetDel. Depending on the
+	// implementation the notification is either a sent value or the channel
+	// being closed (the memory store closes it), so the caller should only
+	// read it once; it stops being serviced once ctx is done.
+	Notify(ctx context.Context, key string) (<-chan struct{}, error)
+
+	Close() error
+}
+
+// NewStore builds a Store from a connection URL, selecting the backend by
+// scheme: redis:// and rediss:// talk to Redis, memory:// keeps an in-process
+// map (local dev/tests), and postgres:// uses a table-backed Store for
+// operators without a Redis instance available (e.g. Heroku Postgres).
+func NewStore(ctx context.Context, rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing store url: %w", err)
+	}
+
+	switch u.Scheme {
+	case "redis", "rediss":
+		redisClient, err := setupRedis(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring redis: %w", err)
+		}
+
+		return NewRedisStore(redisClient), nil
+	case "memory":
+		return NewMemStore(), nil
+	case "postgres", "postgresql":
+		return NewPostgresStore(ctx, rawURL)
+	default:
+		return nil, fmt.Errorf("unsupported store url scheme: %q", u.Scheme)
+	}
 }
 
 type value struct {
@@ -19,12 +66,13 @@ type value struct {
 }
 
 type memStore struct {
-	m sync.Mutex
-	d map[string]value
+	m       sync.Mutex
+	d       map[string]value
+	waiters map[string][]chan struct{}
 }
 
 func NewMemStore() Store {
-	return &memStore{d: make(map[string]value)}
+	return &memStore{d: make(map[string]value), waiters: make(map[string][]chan struct{})}
 }
 
 func (ms *memStore) GetDel(_ context.Context, key string) (string, error) {
@@ -35,38 +83,325 @@ func (ms *memStore) GetDel(_ context.Context, key string) (string, error) {
 	if !ok {
 		return "", redis.Nil
 	}
-	if time.Now().After(val.exp) {
-		delete(ms.d, key)
-
-		return "", redis.Nil
-	}
 
 	delete(ms.d, key)
 
+	if time.Now().After(val.exp) {
+		return "", ErrGone
+	}
+
 	return val.val, nil
 }
 
 func (ms *memStore) SetEx(_ context.Context, key, val string, exp time.Duration) error {
 	ms.m.Lock()
-	defer ms.m.Unlock()
 
 	ms.d[key] = value{val: val, exp: time.Now().Add(exp)}
 
+	waiters := ms.waiters[key]
+	delete(ms.waiters, key)
+
+	ms.m.Unlock()
+
+	for _, ch := range waiters {
+		close(ch)
+	}
+
+	return nil
+}
+
+func (ms *memStore) Notify(ctx context.Context, key string) (<-chan struct{}, error) {
+	ch := make(chan struct{})
+
+	ms.m.Lock()
+	ms.waiters[key] = append(ms.waiters[key], ch)
+	ms.m.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		ms.removeWaiter(key, ch)
+	}()
+
+	return ch, nil
+}
+
+func (ms *memStore) removeWaiter(key string, target chan struct{}) {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	waiters := ms.waiters[key]
+	for i, ch := range waiters {
+		if ch == target {
+			ms.waiters[key] = append(waiters[:i], waiters[i+1:]...)
+
+			return
+		}
+	}
+}
+
+func (ms *memStore) Close() error {
 	return nil
 }
 
 type redisStore struct {
-	r *redis.Client
+	r       *redis.Client
+	breaker *circuitBreaker
+
+	notifyOnce sync.Once
+	notifyErr  error
 }
 
 func NewRedisStore(r *redis.Client) Store {
-	return &redisStore{r: r}
+	return &redisStore{r: r, breaker: newCircuitBreaker(redisBreakerThreshold())}
 }
 
 func (rs *redisStore) GetDel(ctx context.Context, key string) (string, error) {
-	return rs.r.GetDel(ctx, key).Result()
+	if !rs.breaker.allow(ctx) {
+		return "", ErrStoreUnavailable
+	}
+
+	var result string
+
+	err := redisRetry(ctx, func() error {
+		v, err := rs.r.GetDel(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+
+		result = v
+
+		return nil
+	})
+
+	rs.breaker.record(ctx, err)
+
+	return result, err
 }
 
 func (rs *redisStore) SetEx(ctx context.Context, key, val string, exp time.Duration) error {
-	return rs.r.SetEX(ctx, key, val, exp).Err()
+	if !rs.breaker.allow(ctx) {
+		return ErrStoreUnavailable
+	}
+
+	err := redisRetry(ctx, func() error {
+		return rs.r.SetEX(ctx, key, val, exp).Err()
+	})
+
+	rs.breaker.record(ctx, err)
+
+	return err
+}
+
+// Notify subscribes to Redis keyspace notifications for "set" events and
+// returns a channel that receives once key is observed, so CodeHandler can
+// block on a callback instead of polling GetDel.
+func (rs *redisStore) Notify(ctx context.Context, key string) (<-chan struct{}, error) {
+	if err := rs.enableKeyspaceNotifications(ctx); err != nil {
+		return nil, err
+	}
+
+	pubsub := rs.r.PSubscribe(ctx, "__keyevent@*__:set")
+
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+
+		return nil, fmt.Errorf("error subscribing to keyspace notifications: %w", err)
+	}
+
+	ch := make(chan struct{}, 1)
+
+	go func() {
+		defer pubsub.Close()
+
+		msgs := pubsub.Channel()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+
+				if msg.Payload != key {
+					continue
+				}
+
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (rs *redisStore) enableKeyspaceNotifications(ctx context.Context) error {
+	rs.notifyOnce.Do(func() {
+		// "E$" enables keyevent notifications (E) for the string-command
+		// class ($), which covers SET/SETEX and is what publishes to
+		// __keyevent@*__:set. "Ex" (the expired class) never fires here,
+		// since Notify cares about a key being written, not expiring.
+		rs.notifyErr = rs.r.ConfigSet(ctx, "notify-keyspace-events", "E$").Err()
+	})
+
+	return rs.notifyErr
+}
+
+func (rs *redisStore) Close() error {
+	return rs.r.Close()
+}
+
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS gamf_kv (
+	key text PRIMARY KEY,
+	value bytea NOT NULL,
+	expires_at timestamptz NOT NULL
+)`
+
+const postgresReapInterval = 30 * time.Second
+
+// postgresStore implements Store on top of a single gamf_kv table, for
+// operators who don't have a Redis instance available. A background goroutine
+// periodically prunes expired rows, since unlike Redis there's no native TTL
+// to rely on.
+type postgresStore struct {
+	db     *sql.DB
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewPostgresStore(ctx context.Context, rawURL string) (Store, error) {
+	db, err := sql.Open("postgres", rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("error opening postgres connection: %w", err)
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("error connecting to postgres: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, postgresSchema); err != nil {
+		return nil, fmt.Errorf("error creating gamf_kv table: %w", err)
+	}
+
+	reapCtx, cancel := context.WithCancel(context.Background())
+
+	ps := &postgresStore{db: db, cancel: cancel, done: make(chan struct{})}
+
+	go ps.reap(reapCtx)
+
+	return ps, nil
+}
+
+func (ps *postgresStore) GetDel(ctx context.Context, key string) (string, error) {
+	var (
+		value     []byte
+		expiresAt time.Time
+	)
+
+	// A single DELETE ... RETURNING both removes the row and tells us
+	// whether it had already expired, in one atomic statement. Splitting
+	// this into a conditional delete followed by a second, unconditional
+	// delete (to distinguish expired-but-present from never-existed) left a
+	// window where a concurrent SetEx between the two statements could have
+	// its fresh write deleted out from under it.
+	row := ps.db.QueryRowContext(ctx, `
+		DELETE FROM gamf_kv
+		WHERE key = $1
+		RETURNING value, expires_at`, key)
+
+	switch err := row.Scan(&value, &expiresAt); {
+	case err == sql.ErrNoRows:
+		return "", redis.Nil
+	case err != nil:
+		return "", fmt.Errorf("error deleting key: %w", err)
+	}
+
+	if !expiresAt.After(time.Now()) {
+		return "", ErrGone
+	}
+
+	return string(value), nil
+}
+
+func (ps *postgresStore) SetEx(ctx context.Context, key, val string, exp time.Duration) error {
+	_, err := ps.db.ExecContext(ctx, `
+		INSERT INTO gamf_kv (key, value, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`,
+		key, []byte(val), time.Now().Add(exp))
+	if err != nil {
+		return fmt.Errorf("error storing key: %w", err)
+	}
+
+	return nil
+}
+
+const postgresNotifyPollInterval = 200 * time.Millisecond
+
+// Notify has no native pub/sub wired up for Postgres here, so it falls back
+// to polling for the key's existence. It's good enough to unblock a
+// long-poll/SSE client well inside the request's wait window without paying
+// for LISTEN/NOTIFY plumbing on a backend chosen for its simplicity.
+func (ps *postgresStore) Notify(ctx context.Context, key string) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+
+	go func() {
+		ticker := time.NewTicker(postgresNotifyPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				var exists bool
+
+				row := ps.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM gamf_kv WHERE key = $1 AND expires_at > now())`, key)
+				if err := row.Scan(&exists); err != nil || !exists {
+					continue
+				}
+
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (ps *postgresStore) Close() error {
+	ps.cancel()
+	<-ps.done
+
+	return ps.db.Close()
+}
+
+func (ps *postgresStore) reap(ctx context.Context) {
+	defer close(ps.done)
+
+	ticker := time.NewTicker(postgresReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := ps.db.ExecContext(ctx, `DELETE FROM gamf_kv WHERE expires_at <= now()`); err != nil {
+				fmt.Printf("error: failed to reap expired gamf_kv rows: %v\n", err)
+			}
+		}
+	}
 }
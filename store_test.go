@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestMemStoreNotify(t *testing.T) {
+	ms := NewMemStore()
+	ctx := context.Background()
+
+	ch, err := ms.Notify(ctx, "s:abc")
+	if err != nil {
+		t.Fatalf("Notify returned error: %v", err)
+	}
+
+	if err := ms.SetEx(ctx, "s:abc", "code", time.Minute); err != nil {
+		t.Fatalf("SetEx returned error: %v", err)
+	}
+
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("Notify channel did not fire after SetEx")
+	}
+
+	code, err := ms.GetDel(ctx, "s:abc")
+	if err != nil {
+		t.Fatalf("GetDel returned error: %v", err)
+	}
+
+	if code != "code" {
+		t.Fatalf("GetDel returned %q, want %q", code, "code")
+	}
+}
+
+func TestMemStoreNotifyCancelRemovesWaiter(t *testing.T) {
+	ms := NewMemStore().(*memStore)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if _, err := ms.Notify(ctx, "s:abc"); err != nil {
+		t.Fatalf("Notify returned error: %v", err)
+	}
+
+	cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		ms.m.Lock()
+		n := len(ms.waiters["s:abc"])
+		ms.m.Unlock()
+
+		if n == 0 {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatal("waiter was not removed after context cancellation")
+}
+
+func TestMemStoreGetDelMissing(t *testing.T) {
+	ms := NewMemStore()
+
+	if _, err := ms.GetDel(context.Background(), "missing"); err != redis.Nil {
+		t.Fatalf("GetDel on missing key returned %v, want redis.Nil", err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type contextKey string
+
+const requestIDContextKey contextKey = "request_id"
+
+// requestIDMiddleware ensures every request carries an X-Request-ID: it
+// echoes one supplied by the caller or generates one, attaches it to the
+// response and the active span, and threads it through the request context
+// so handlers (in particular the /v2 error envelope) can report it back.
+func requestIDMiddleware(n http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			generated, err := token()
+			if err != nil {
+				generated = "unknown"
+			}
+
+			id = generated
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.request_id", id))
+
+		n.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	})
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+
+	return id
+}
+
+// v2Error is the stable error shape returned by every /v2 handler, replacing
+// the ad-hoc {"error": "..."} fragments on the v1 surface.
+type v2Error struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	RequestID string            `json:"request_id"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+type v2ErrorEnvelope struct {
+	Error v2Error `json:"error"`
+}
+
+func writeV2Error(w http.ResponseWriter, r *http.Request, status int, code, message string, fields map[string]string) {
+	envelope := v2ErrorEnvelope{Error: v2Error{
+		Code:      code,
+		Message:   message,
+		RequestID: requestIDFromContext(r.Context()),
+		Fields:    fields,
+	}}
+
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		fmt.Printf("error: failed to marshal v2 error envelope: %v\n", err)
+		payload = []byte(`{"error":{"code":"internal","message":"failed to encode error"}}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(payload)
+}
+
+// writeStoreErrorV2 maps the Store-level errors shared across v2 handlers
+// onto the envelope, so GetDel/SetEx callers don't each re-derive this
+// switch.
+func writeStoreErrorV2(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrGone):
+		writeV2Error(w, r, http.StatusGone, "gone", "the code for this key has already expired", nil)
+	case err == redis.Nil:
+		writeV2Error(w, r, http.StatusNotFound, "not_found", "no code found for the given key", nil)
+	case errors.Is(err, ErrStoreUnavailable):
+		writeV2Error(w, r, http.StatusServiceUnavailable, "unavailable", "store temporarily unavailable", nil)
+	default:
+		writeV2Error(w, r, http.StatusInternalServerError, "internal", "unexpected store error", nil)
+	}
+}
+
+// v2ValidDefaultEvents is the set of manifest default_events GitHub accepts
+// as of writing. It isn't exhaustive against future GitHub additions, but
+// catches the typo/placeholder case this validation exists for.
+var v2ValidDefaultEvents = map[string]bool{
+	"check_run": true, "check_suite": true, "commit_comment": true,
+	"create": true, "delete": true, "deployment": true, "deployment_status": true,
+	"fork": true, "gollum": true, "issue_comment": true, "issues": true,
+	"label": true, "member": true, "milestone": true, "organization": true,
+	"page_build": true, "project": true, "project_card": true, "project_column": true,
+	"public": true, "pull_request": true, "pull_request_review": true,
+	"pull_request_review_comment": true, "push": true, "release": true,
+	"repository": true, "status": true, "team_add": true, "watch": true,
+}
+
+var v2ValidPermissionValues = map[string]bool{"none": true, "read": true, "write": true, "admin": true}
+
+// validateV2Manifest checks the fields GitHub's manifest flow requires and
+// returns a per-field message for anything that fails, so callers can fix
+// their request in one round-trip instead of guessing from a single error.
+func validateV2Manifest(m manifest) map[string]string {
+	fields := map[string]string{}
+
+	if m.Name == "" {
+		fields["manifest.name"] = "is required"
+	}
+
+	if m.URL == "" {
+		fields["manifest.url"] = "is required"
+	}
+
+	for _, event := range m.DefaultEvents {
+		if !v2ValidDefaultEvents[event] {
+			fields["manifest.default_events"] = fmt.Sprintf("unknown event %q", event)
+
+			break
+		}
+	}
+
+	for permission, value := range m.DefaultPermissions {
+		if !v2ValidPermissionValues[value] {
+			fields["manifest.default_permissions."+permission] = fmt.Sprintf("unknown permission value %q", value)
+		}
+	}
+
+	return fields
+}
+
+// v2TokensFromEnv parses GAMF_API_TOKENS into a set of accepted bearer
+// tokens. An unset or empty value disables auth on /v2/start, preserving
+// today's open-by-default behaviour for operators who haven't opted in.
+func v2TokensFromEnv() map[string]bool {
+	raw := os.Getenv("GAMF_API_TOKENS")
+	if raw == "" {
+		return nil
+	}
+
+	tokens := map[string]bool{}
+
+	for _, t := range strings.Split(raw, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens[t] = true
+		}
+	}
+
+	return tokens
+}
+
+func v2Authorized(r *http.Request, tokens map[string]bool) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+
+	const prefix = "Bearer "
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+
+	return tokens[strings.TrimPrefix(auth, prefix)]
+}
+
+func V2StartHandler(baseURL string, store Store, tokens map[string]bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !v2Authorized(r, tokens) {
+			writeV2Error(w, r, http.StatusForbidden, "forbidden", "missing or invalid bearer token", nil)
+
+			return
+		}
+
+		var request startRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeV2Error(w, r, http.StatusBadRequest, "invalid_request", "failed to parse request body", nil)
+
+			return
+		}
+
+		if fields := validateV2Manifest(request.Manifest); len(fields) > 0 {
+			writeV2Error(w, r, http.StatusBadRequest, "invalid_request", "manifest failed validation", fields)
+
+			return
+		}
+
+		key, redirectURL, err := startFlow(r.Context(), baseURL, store, request)
+		if err != nil {
+			if errors.Is(err, ErrInvalidCallbackWebhook) {
+				writeV2Error(w, r, http.StatusBadRequest, "invalid_request", "callback_webhook is invalid or disallowed",
+					map[string]string{"callback_webhook": err.Error()})
+
+				return
+			}
+
+			writeStoreErrorV2(w, r, err)
+
+			return
+		}
+
+		response := struct {
+			Key string `json:"key"`
+			URL string `json:"url"`
+		}{Key: key, URL: redirectURL}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			fmt.Printf("error: failed to write v2 start response: %v\n", err)
+		}
+	}
+}
+
+func V2CodeHandler(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := "s:" + mux.Vars(r)["key"]
+		wait := parseCodeWait(r.URL.Query().Get("wait"))
+
+		code, err := fetchCode(r.Context(), store, key, wait)
+		if err != nil {
+			writeStoreErrorV2(w, r, err)
+
+			return
+		}
+
+		response := struct {
+			Code string `json:"code"`
+		}{Code: code}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			fmt.Printf("error: failed to write v2 code response: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	webhookWorkers     = 4
+	webhookQueueSize   = 256
+	webhookMaxAttempts = 5
+	webhookBaseDelay   = 250 * time.Millisecond
+	webhookMaxDelay    = 5 * time.Second
+)
+
+type cloudEvent struct {
+	ID          string
+	Source      string
+	Type        string
+	SpecVersion string
+	Data        json.RawMessage
+}
+
+type appCreatedData struct {
+	Key        string `json:"key"`
+	TargetType string `json:"target_type"`
+	TargetSlug string `json:"target_slug"`
+	Host       string `json:"host"`
+}
+
+// ErrInvalidCallbackWebhook is returned when a caller-supplied
+// callback_webhook fails validateWebhookURL, e.g. because it isn't https or
+// resolves to a loopback/private/link-local address.
+var ErrInvalidCallbackWebhook = errors.New("webhook: invalid or disallowed callback url")
+
+// validateWebhookURL guards against SSRF: callback_webhook is a URL supplied
+// by whoever starts the manifest flow, and Deliver would otherwise happily
+// make a server-side request to it, including to loopback or
+// internal/private network addresses. Only https URLs resolving exclusively
+// to public addresses are allowed. It returns the resolved address so the
+// caller can pin the outbound connection to it (see pinnedClient) rather
+// than re-resolving the hostname at dial time, which an attacker controlling
+// DNS could answer differently the second time around (DNS rebinding).
+func validateWebhookURL(raw string) (net.IP, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCallbackWebhook, err)
+	}
+
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("%w: scheme must be https", ErrInvalidCallbackWebhook)
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("%w: missing host", ErrInvalidCallbackWebhook)
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not resolve host: %v", ErrInvalidCallbackWebhook, err)
+	}
+
+	for _, ip := range ips {
+		if isDisallowedWebhookIP(ip) {
+			return nil, fmt.Errorf("%w: %v resolves to a disallowed address", ErrInvalidCallbackWebhook, host)
+		}
+	}
+
+	return ips[0], nil
+}
+
+func isDisallowedWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() ||
+		ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() ||
+		ip.IsMulticast()
+}
+
+type webhookDelivery struct {
+	url      string
+	secret   string
+	event    cloudEvent
+	pinnedIP net.IP
+}
+
+// WebhookDispatcher delivers CloudEvents to caller-supplied URLs through a
+// small pool of workers, so a slow or unreachable endpoint can't block the
+// callback flow.
+type WebhookDispatcher struct {
+	queue  chan webhookDelivery
+	client *http.Client
+}
+
+func NewWebhookDispatcher(workers int) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		queue:  make(chan webhookDelivery, webhookQueueSize),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+
+	return d
+}
+
+// Deliver enqueues a CloudEvent for delivery to url, signed with secret. It
+// is fire-and-forget: a full queue drops the delivery rather than blocking
+// the caller.
+func (d *WebhookDispatcher) Deliver(url, secret string, event cloudEvent) {
+	if url == "" {
+		return
+	}
+
+	// Re-validate here, not just at intake: this is the one chokepoint every
+	// delivery passes through before an outbound request is made. The
+	// resolved IP is pinned onto the delivery and every attempt dials it
+	// directly (see pinnedClient) instead of letting the HTTP client
+	// re-resolve the hostname at connect time, which would let a
+	// caller-controlled DNS record answer this check with a public address
+	// and the real connection with an internal one (DNS rebinding).
+	pinnedIP, err := validateWebhookURL(url)
+	if err != nil {
+		fmt.Printf("error: refusing to deliver webhook to %v: %v\n", url, err)
+
+		return
+	}
+
+	select {
+	case d.queue <- webhookDelivery{url: url, secret: secret, event: event, pinnedIP: pinnedIP}:
+	default:
+		fmt.Printf("error: webhook queue full, dropping delivery to %v\n", url)
+	}
+}
+
+func (d *WebhookDispatcher) work() {
+	for delivery := range d.queue {
+		d.deliver(delivery)
+	}
+}
+
+func (d *WebhookDispatcher) deliver(delivery webhookDelivery) {
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(webhookBackoff(attempt - 1))
+		}
+
+		if err := d.attempt(delivery); err != nil {
+			fmt.Printf("error: webhook delivery attempt %v/%v to %v failed: %v\n", attempt, webhookMaxAttempts, delivery.url, err)
+
+			continue
+		}
+
+		return
+	}
+
+	fmt.Printf("error: webhook delivery to %v failed after %v attempts\n", delivery.url, webhookMaxAttempts)
+}
+
+func (d *WebhookDispatcher) attempt(delivery webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, delivery.url, bytes.NewReader(delivery.event.Data))
+	if err != nil {
+		return fmt.Errorf("error building webhook request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Ce-Id", delivery.event.ID)
+	req.Header.Set("Ce-Source", delivery.event.Source)
+	req.Header.Set("Ce-Type", delivery.event.Type)
+	req.Header.Set("Ce-Specversion", delivery.event.SpecVersion)
+
+	if delivery.secret != "" {
+		req.Header.Set("X-Gamf-Signature", "sha256="+webhookSign(delivery.secret, delivery.event.Data))
+	}
+
+	client := d.client
+	if delivery.pinnedIP != nil {
+		client = pinnedClient(d.client.Timeout, delivery.pinnedIP)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making webhook request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook endpoint returned status %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// pinnedClient returns an http.Client whose DialContext connects directly to
+// ip, ignoring whatever address the runtime resolver would otherwise produce
+// for the request's hostname. net/http still derives the TLS ServerName from
+// the request's original hostname (DialContext only supplies the transport
+// connection, not the TLS config), so this pins the TCP destination without
+// weakening certificate validation.
+func pinnedClient(timeout time.Duration, ip net.IP) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				_, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, fmt.Errorf("error splitting dial address %q: %w", addr, err)
+				}
+
+				return dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			},
+		},
+	}
+}
+
+func webhookSign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff returns a jittered delay for the given (1-indexed) retry
+// attempt, doubling each time up to webhookMaxDelay.
+func webhookBackoff(attempt int) time.Duration {
+	d := webhookBaseDelay * time.Duration(1<<uint(attempt))
+	if d > webhookMaxDelay {
+		d = webhookMaxDelay
+	}
+
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+func newAppCreatedEvent(source string, key string, data appCreatedData) (cloudEvent, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return cloudEvent{}, fmt.Errorf("error marshalling event data: %w", err)
+	}
+
+	id, err := token()
+	if err != nil {
+		return cloudEvent{}, fmt.Errorf("error generating event id: %w", err)
+	}
+
+	return cloudEvent{
+		ID:          id,
+		Source:      source,
+		Type:        "dev.gamf.app.created",
+		SpecVersion: "1.0",
+		Data:        raw,
+	}, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookDispatcherRetriesUntilSuccess(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&attempts, 1)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read request body: %v", err)
+		}
+
+		sig := r.Header.Get("X-Gamf-Signature")
+		if want := "sha256=" + webhookSign("topsecret", body); sig != want {
+			t.Errorf("signature = %q, want %q", sig, want)
+		}
+
+		if n < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	d := &WebhookDispatcher{queue: make(chan webhookDelivery, 1), client: &http.Client{Timeout: time.Second}}
+
+	data, err := json.Marshal(appCreatedData{Key: "abc"})
+	if err != nil {
+		t.Fatalf("failed to marshal test payload: %v", err)
+	}
+
+	event := cloudEvent{ID: "evt", Source: server.URL, Type: "dev.gamf.app.created", SpecVersion: "1.0", Data: data}
+
+	d.deliver(webhookDelivery{url: server.URL, secret: "topsecret", event: event})
+
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Fatalf("server received %v attempts, want 3", got)
+	}
+}
+
+func TestWebhookBackoffStaysWithinBounds(t *testing.T) {
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		d := webhookBackoff(attempt)
+		if d < 0 || d > webhookMaxDelay {
+			t.Fatalf("webhookBackoff(%v) = %v, want within [0, %v]", attempt, d, webhookMaxDelay)
+		}
+	}
+}
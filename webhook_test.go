@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestValidateWebhookURLRejectsNonHTTPS(t *testing.T) {
+	if _, err := validateWebhookURL("http://example.com/hook"); !errors.Is(err, ErrInvalidCallbackWebhook) {
+		t.Fatalf("expected ErrInvalidCallbackWebhook for non-https url, got %v", err)
+	}
+}
+
+func TestValidateWebhookURLRejectsLoopback(t *testing.T) {
+	if _, err := validateWebhookURL("https://localhost/hook"); !errors.Is(err, ErrInvalidCallbackWebhook) {
+		t.Fatalf("expected ErrInvalidCallbackWebhook for loopback host, got %v", err)
+	}
+}
+
+func TestValidateWebhookURLRejectsMalformed(t *testing.T) {
+	if _, err := validateWebhookURL("://not-a-url"); !errors.Is(err, ErrInvalidCallbackWebhook) {
+		t.Fatalf("expected ErrInvalidCallbackWebhook for malformed url, got %v", err)
+	}
+}
+
+// TestPinnedClientDialsPinnedIPNotHostname proves the DNS-rebinding fix: the
+// request targets a hostname that can't resolve at all, yet the pinned
+// client still connects successfully because it dials the pinned IP
+// directly instead of re-resolving the hostname.
+func TestPinnedClientDialsPinnedIPNotHostname(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("failed to parse test server url: %v", err)
+	}
+
+	_, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatalf("failed to split test server host: %v", err)
+	}
+
+	client := pinnedClient(time.Second, net.ParseIP("127.0.0.1"))
+
+	req, err := http.NewRequest(http.MethodGet, "http://this-host-does-not-resolve.invalid:"+port, nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("pinned client request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %v, want 200", resp.StatusCode)
+	}
+}
+
+func TestIsDisallowedWebhookIP(t *testing.T) {
+	cases := []struct {
+		ip         string
+		disallowed bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"169.254.1.1", true},
+		{"10.0.0.1", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+		{"8.8.8.8", false},
+		{"93.184.216.34", false},
+	}
+
+	for _, c := range cases {
+		ip := net.ParseIP(c.ip)
+		if ip == nil {
+			t.Fatalf("failed to parse test ip %v", c.ip)
+		}
+
+		if got := isDisallowedWebhookIP(ip); got != c.disallowed {
+			t.Errorf("isDisallowedWebhookIP(%v) = %v, want %v", c.ip, got, c.disallowed)
+		}
+	}
+}